@@ -0,0 +1,27 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import "io"
+
+// Codec separates a protocol variant's ADU framing and encoding from the
+// transport that moves the bytes. A Transporter only has to read/write a
+// stream; everything about how an ADU is delimited on the wire (TCP's
+// length-prefixed MBAP header, ASCII's ":...\r\n" envelope, RTU's silent
+// interval) and how a PDU is packed into it lives behind this interface
+// instead of being duplicated, or hard-coded, in each transporter.
+type Codec interface {
+	// EncodeADU wraps pdu in the codec's application data unit, ready to
+	// write to the wire.
+	EncodeADU(pdu *ProtocolDataUnit) (adu []byte, err error)
+
+	// DecodeADU extracts the unit id and PDU from a complete ADU, as
+	// produced by ReadFrame.
+	DecodeADU(adu []byte) (unit byte, pdu *ProtocolDataUnit, err error)
+
+	// ReadFrame reads exactly one complete ADU from r, applying whatever
+	// framing rule the codec defines, and returns it unparsed.
+	ReadFrame(r io.Reader) (adu []byte, err error)
+}
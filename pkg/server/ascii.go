@@ -0,0 +1,32 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package server
+
+import "errors"
+
+// ASCIIServer would serve Modbus ASCII requests over a serial port against
+// Handler, the way TCPServer does for Modbus/TCP.
+type ASCIIServer struct {
+	Handler RequestHandler
+}
+
+// NewASCIIServer is not implemented yet: ASCII framing (the ":...\r\n"
+// envelope and LRC) needs an ASCII Codec analogous to tcp.NewCodec, and
+// internal/ascii does not yet export its packager for one to wrap (only its
+// client-side tests live there today). NewRTUServer is stubbed for the same
+// reason, one Codec short of a serial framing implementation.
+func NewASCIIServer(port string, handler RequestHandler) (*ASCIIServer, error) {
+	return nil, errors.New("modbus: ASCII server is not implemented in this tree yet")
+}
+
+// Serve always returns an error; see NewASCIIServer.
+func (s *ASCIIServer) Serve() error {
+	return errors.New("modbus: ASCII server is not implemented in this tree yet")
+}
+
+// Close is a no-op since Serve never starts.
+func (s *ASCIIServer) Close() error {
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+// Package server implements a Modbus slave/server: it decodes requests read
+// off a Codec, dispatches them to a user-supplied RequestHandler, and
+// encodes the handler's result (or exception) back into a response PDU.
+package server
+
+import (
+	"encoding/binary"
+
+	modbus "github.com/OpenVoIP/modbus/pkg"
+)
+
+// ExceptionCode is a Modbus exception, returned by a RequestHandler to
+// signal a well-defined failure. It implements error so handler methods can
+// return it directly.
+type ExceptionCode byte
+
+// Standard Modbus exception codes.
+const (
+	ExceptionIllegalFunction    ExceptionCode = 0x01
+	ExceptionIllegalDataAddress ExceptionCode = 0x02
+	ExceptionIllegalDataValue   ExceptionCode = 0x03
+	ExceptionSlaveDeviceFailure ExceptionCode = 0x04
+)
+
+func (e ExceptionCode) Error() string {
+	switch e {
+	case ExceptionIllegalFunction:
+		return "illegal function"
+	case ExceptionIllegalDataAddress:
+		return "illegal data address"
+	case ExceptionIllegalDataValue:
+		return "illegal data value"
+	case ExceptionSlaveDeviceFailure:
+		return "slave device failure"
+	default:
+		return "unknown exception"
+	}
+}
+
+// RequestHandler serves decoded Modbus requests for a given unit (slave) id.
+// Returning an ExceptionCode reports that exact exception to the client;
+// any other error is reported as ExceptionSlaveDeviceFailure.
+type RequestHandler interface {
+	ReadCoils(unit byte, address, quantity uint16) ([]bool, error)
+	ReadDiscreteInputs(unit byte, address, quantity uint16) ([]bool, error)
+	ReadHoldingRegisters(unit byte, address, quantity uint16) ([]uint16, error)
+	ReadInputRegisters(unit byte, address, quantity uint16) ([]uint16, error)
+	WriteSingleCoil(unit byte, address uint16, value bool) error
+	WriteSingleRegister(unit byte, address, value uint16) error
+	WriteMultipleCoils(unit byte, address uint16, values []bool) error
+	WriteMultipleRegisters(unit byte, address uint16, values []uint16) error
+	MaskWriteRegister(unit byte, address, andMask, orMask uint16) error
+	ReadWriteMultipleRegisters(unit byte, readAddress, readQuantity, writeAddress uint16, writeValues []uint16) ([]uint16, error)
+	ReadFIFOQueue(unit byte, address uint16) ([]uint16, error)
+}
+
+// dispatch decodes request's Data for FunctionCode, calls the matching
+// RequestHandler method, and returns the encoded response PDU (which is an
+// exception PDU if the handler or the request itself is at fault).
+func dispatch(handler RequestHandler, unit byte, request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+	data := request.Data
+	switch request.FunctionCode {
+	case 1, 2:
+		if len(data) != 4 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		quantity := binary.BigEndian.Uint16(data[2:])
+		readFn := handler.ReadCoils
+		if request.FunctionCode == 2 {
+			readFn = handler.ReadDiscreteInputs
+		}
+		values, err := readFn(unit, address, quantity)
+		if err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		packed := packBits(values)
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte{byte(len(packed))}, packed...)}
+
+	case 3, 4:
+		if len(data) != 4 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		quantity := binary.BigEndian.Uint16(data[2:])
+		readFn := handler.ReadHoldingRegisters
+		if request.FunctionCode == 4 {
+			readFn = handler.ReadInputRegisters
+		}
+		values, err := readFn(unit, address, quantity)
+		if err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		packed := packRegisters(values)
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte{byte(len(packed))}, packed...)}
+
+	case 5:
+		if len(data) != 4 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		value := binary.BigEndian.Uint16(data[2:]) == 0xFF00
+		if err := handler.WriteSingleCoil(unit, address, value); err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte(nil), data...)}
+
+	case 6:
+		if len(data) != 4 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		value := binary.BigEndian.Uint16(data[2:])
+		if err := handler.WriteSingleRegister(unit, address, value); err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte(nil), data...)}
+
+	case 15:
+		if len(data) < 5 || len(data) != int(5+data[4]) {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		quantity := binary.BigEndian.Uint16(data[2:])
+		if int(data[4]) != (int(quantity)+7)/8 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		values := unpackBits(data[5:], int(quantity))
+		if err := handler.WriteMultipleCoils(unit, address, values); err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: data[:4]}
+
+	case 16:
+		if len(data) < 5 || len(data) != int(5+data[4]) || int(data[4]) != int(binary.BigEndian.Uint16(data[2:]))*2 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		values := unpackRegisters(data[5:])
+		if err := handler.WriteMultipleRegisters(unit, address, values); err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: data[:4]}
+
+	case 22:
+		if len(data) != 6 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		andMask := binary.BigEndian.Uint16(data[2:])
+		orMask := binary.BigEndian.Uint16(data[4:])
+		if err := handler.MaskWriteRegister(unit, address, andMask, orMask); err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte(nil), data...)}
+
+	case 23:
+		if len(data) < 9 || len(data) != int(9+data[8]) || int(data[8]) != int(binary.BigEndian.Uint16(data[6:]))*2 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		readAddress := binary.BigEndian.Uint16(data)
+		readQuantity := binary.BigEndian.Uint16(data[2:])
+		writeAddress := binary.BigEndian.Uint16(data[4:])
+		writeValues := unpackRegisters(data[9:])
+		values, err := handler.ReadWriteMultipleRegisters(unit, readAddress, readQuantity, writeAddress, writeValues)
+		if err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		packed := packRegisters(values)
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte{byte(len(packed))}, packed...)}
+
+	case 24:
+		if len(data) != 2 {
+			return exceptionPDU(request.FunctionCode, ExceptionIllegalDataValue)
+		}
+		address := binary.BigEndian.Uint16(data)
+		values, err := handler.ReadFIFOQueue(unit, address)
+		if err != nil {
+			return exceptionPDU(request.FunctionCode, err)
+		}
+		packed := packRegisters(values)
+		resp := make([]byte, 4+len(packed))
+		binary.BigEndian.PutUint16(resp, uint16(2+len(packed)))
+		binary.BigEndian.PutUint16(resp[2:], uint16(len(values)))
+		copy(resp[4:], packed)
+		return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: resp}
+
+	default:
+		return exceptionPDU(request.FunctionCode, ExceptionIllegalFunction)
+	}
+}
+
+// exceptionPDU builds a response PDU for a Modbus exception: the request's
+// function code with its high bit set, followed by a single exception code
+// byte, per the spec.
+func exceptionPDU(functionCode byte, err error) *modbus.ProtocolDataUnit {
+	code, ok := err.(ExceptionCode)
+	if !ok {
+		code = ExceptionSlaveDeviceFailure
+	}
+	return &modbus.ProtocolDataUnit{
+		FunctionCode: functionCode | 0x80,
+		Data:         []byte{byte(code)},
+	}
+}
+
+func packBits(values []bool) []byte {
+	out := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			out[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return out
+}
+
+func unpackBits(data []byte, count int) []bool {
+	out := make([]bool, count)
+	for i := 0; i < count; i++ {
+		out[i] = data[i/8]&(1<<uint(i%8)) != 0
+	}
+	return out
+}
+
+func packRegisters(values []uint16) []byte {
+	out := make([]byte, len(values)*2)
+	for i, v := range values {
+		binary.BigEndian.PutUint16(out[i*2:], v)
+	}
+	return out
+}
+
+func unpackRegisters(data []byte) []uint16 {
+	out := make([]uint16, len(data)/2)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	modbus "github.com/OpenVoIP/modbus/pkg"
+)
+
+func TestDispatchReadHoldingRegisters(t *testing.T) {
+	h := NewMemoryHandler(0, 0, 10, 0)
+	h.HoldingRegisters[3] = 0x1234
+	h.HoldingRegisters[4] = 0x5678
+
+	resp := dispatch(h, 1, &modbus.ProtocolDataUnit{FunctionCode: 3, Data: []byte{0, 3, 0, 2}})
+
+	if resp.FunctionCode != 3 {
+		t.Fatalf("FunctionCode = %#x, want 3", resp.FunctionCode)
+	}
+	expected := []byte{4, 0x12, 0x34, 0x56, 0x78}
+	if !bytes.Equal(resp.Data, expected) {
+		t.Fatalf("Data = % x, want % x", resp.Data, expected)
+	}
+}
+
+func TestDispatchWriteMultipleCoils(t *testing.T) {
+	h := NewMemoryHandler(10, 0, 0, 0)
+
+	// Write 10 coils starting at address 0: byte count 2, bits 0b00000011 0b00000001.
+	request := []byte{0, 0, 0, 10, 2, 0x03, 0x01}
+	resp := dispatch(h, 1, &modbus.ProtocolDataUnit{FunctionCode: 15, Data: request})
+
+	if resp.FunctionCode != 15 {
+		t.Fatalf("FunctionCode = %#x, want 15", resp.FunctionCode)
+	}
+	if !bytes.Equal(resp.Data, []byte{0, 0, 0, 10}) {
+		t.Fatalf("Data = % x, want echoed address/quantity", resp.Data)
+	}
+	if !h.Coils[0] || !h.Coils[1] || h.Coils[2] || !h.Coils[8] {
+		t.Fatalf("coils not written: %v", h.Coils)
+	}
+}
+
+// TestDispatchWriteMultipleCoilsBadByteCount guards against a regression
+// where a byte count smaller than ceil(quantity/8) made unpackBits index
+// past the end of data and panic instead of returning an exception.
+func TestDispatchWriteMultipleCoilsBadByteCount(t *testing.T) {
+	h := NewMemoryHandler(2000, 0, 0, 0)
+
+	// quantity = 2000 (0x07D0) claims a byte count of 1, far short of the
+	// 250 bytes that many coils actually require.
+	request := []byte{0, 0, 0x07, 0xD0, 1, 0xFF}
+	resp := dispatch(h, 1, &modbus.ProtocolDataUnit{FunctionCode: 15, Data: request})
+
+	if resp.FunctionCode != 15|0x80 {
+		t.Fatalf("FunctionCode = %#x, want exception bit set", resp.FunctionCode)
+	}
+	if len(resp.Data) != 1 || ExceptionCode(resp.Data[0]) != ExceptionIllegalDataValue {
+		t.Fatalf("Data = % x, want illegal data value exception", resp.Data)
+	}
+}
+
+func TestDispatchWriteMultipleRegisters(t *testing.T) {
+	h := NewMemoryHandler(0, 0, 10, 0)
+
+	request := []byte{0, 5, 0, 2, 4, 0x00, 0x0A, 0x00, 0x0B}
+	resp := dispatch(h, 1, &modbus.ProtocolDataUnit{FunctionCode: 16, Data: request})
+
+	if resp.FunctionCode != 16 {
+		t.Fatalf("FunctionCode = %#x, want 16", resp.FunctionCode)
+	}
+	if !bytes.Equal(resp.Data, []byte{0, 5, 0, 2}) {
+		t.Fatalf("Data = % x, want echoed address/quantity", resp.Data)
+	}
+	if h.HoldingRegisters[5] != 0x0A || h.HoldingRegisters[6] != 0x0B {
+		t.Fatalf("registers not written: %v", h.HoldingRegisters)
+	}
+}
+
+func TestDispatchIllegalDataAddress(t *testing.T) {
+	h := NewMemoryHandler(0, 0, 4, 0)
+
+	resp := dispatch(h, 1, &modbus.ProtocolDataUnit{FunctionCode: 3, Data: []byte{0, 0, 0, 10}})
+
+	if resp.FunctionCode != 3|0x80 {
+		t.Fatalf("FunctionCode = %#x, want exception bit set", resp.FunctionCode)
+	}
+	if len(resp.Data) != 1 || ExceptionCode(resp.Data[0]) != ExceptionIllegalDataAddress {
+		t.Fatalf("Data = % x, want illegal data address exception", resp.Data)
+	}
+}
+
+func TestDispatchIllegalFunction(t *testing.T) {
+	h := NewMemoryHandler(0, 0, 0, 0)
+
+	resp := dispatch(h, 1, &modbus.ProtocolDataUnit{FunctionCode: 99, Data: nil})
+
+	if resp.FunctionCode != 99|0x80 {
+		t.Fatalf("FunctionCode = %#x, want exception bit set", resp.FunctionCode)
+	}
+	if ExceptionCode(resp.Data[0]) != ExceptionIllegalFunction {
+		t.Fatalf("exception = %#x, want illegal function", resp.Data[0])
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package server
+
+import "sync"
+
+// MemoryHandler is a RequestHandler backed by in-memory coil, discrete
+// input, holding register and input register tables, analogous to the
+// simulated slave libmodbus ships for testing. The unit id is ignored: a
+// MemoryHandler answers for a single unit.
+type MemoryHandler struct {
+	mu sync.RWMutex
+
+	Coils            []bool
+	DiscreteInputs   []bool
+	HoldingRegisters []uint16
+	InputRegisters   []uint16
+}
+
+// NewMemoryHandler allocates a MemoryHandler with the given table sizes.
+func NewMemoryHandler(coils, discreteInputs, holdingRegisters, inputRegisters int) *MemoryHandler {
+	return &MemoryHandler{
+		Coils:            make([]bool, coils),
+		DiscreteInputs:   make([]bool, discreteInputs),
+		HoldingRegisters: make([]uint16, holdingRegisters),
+		InputRegisters:   make([]uint16, inputRegisters),
+	}
+}
+
+func (h *MemoryHandler) ReadCoils(_ byte, address, quantity uint16) ([]bool, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return readBools(h.Coils, address, quantity)
+}
+
+func (h *MemoryHandler) ReadDiscreteInputs(_ byte, address, quantity uint16) ([]bool, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return readBools(h.DiscreteInputs, address, quantity)
+}
+
+func (h *MemoryHandler) ReadHoldingRegisters(_ byte, address, quantity uint16) ([]uint16, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return readUint16s(h.HoldingRegisters, address, quantity)
+}
+
+func (h *MemoryHandler) ReadInputRegisters(_ byte, address, quantity uint16) ([]uint16, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return readUint16s(h.InputRegisters, address, quantity)
+}
+
+func (h *MemoryHandler) WriteSingleCoil(_ byte, address uint16, value bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if int(address) >= len(h.Coils) {
+		return ExceptionIllegalDataAddress
+	}
+	h.Coils[address] = value
+	return nil
+}
+
+func (h *MemoryHandler) WriteSingleRegister(_ byte, address, value uint16) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if int(address) >= len(h.HoldingRegisters) {
+		return ExceptionIllegalDataAddress
+	}
+	h.HoldingRegisters[address] = value
+	return nil
+}
+
+func (h *MemoryHandler) WriteMultipleCoils(_ byte, address uint16, values []bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if int(address)+len(values) > len(h.Coils) {
+		return ExceptionIllegalDataAddress
+	}
+	copy(h.Coils[address:], values)
+	return nil
+}
+
+func (h *MemoryHandler) WriteMultipleRegisters(_ byte, address uint16, values []uint16) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if int(address)+len(values) > len(h.HoldingRegisters) {
+		return ExceptionIllegalDataAddress
+	}
+	copy(h.HoldingRegisters[address:], values)
+	return nil
+}
+
+func (h *MemoryHandler) MaskWriteRegister(_ byte, address, andMask, orMask uint16) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if int(address) >= len(h.HoldingRegisters) {
+		return ExceptionIllegalDataAddress
+	}
+	h.HoldingRegisters[address] = (h.HoldingRegisters[address] & andMask) | (orMask &^ andMask)
+	return nil
+}
+
+func (h *MemoryHandler) ReadWriteMultipleRegisters(_ byte, readAddress, readQuantity, writeAddress uint16, writeValues []uint16) ([]uint16, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if int(writeAddress)+len(writeValues) > len(h.HoldingRegisters) {
+		return nil, ExceptionIllegalDataAddress
+	}
+	copy(h.HoldingRegisters[writeAddress:], writeValues)
+	return readUint16s(h.HoldingRegisters, readAddress, readQuantity)
+}
+
+func (h *MemoryHandler) ReadFIFOQueue(_ byte, address uint16) ([]uint16, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if int(address) >= len(h.HoldingRegisters) {
+		return nil, ExceptionIllegalDataAddress
+	}
+	count := h.HoldingRegisters[address]
+	return readUint16s(h.HoldingRegisters, address+1, count)
+}
+
+// readBools and readUint16s assume the caller already holds h.mu.
+
+func readBools(table []bool, address, quantity uint16) ([]bool, error) {
+	if int(address)+int(quantity) > len(table) {
+		return nil, ExceptionIllegalDataAddress
+	}
+	out := make([]bool, quantity)
+	copy(out, table[address:])
+	return out, nil
+}
+
+func readUint16s(table []uint16, address, quantity uint16) ([]uint16, error) {
+	if int(address)+int(quantity) > len(table) {
+		return nil, ExceptionIllegalDataAddress
+	}
+	out := make([]uint16, quantity)
+	copy(out, table[address:])
+	return out, nil
+}
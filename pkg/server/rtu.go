@@ -0,0 +1,31 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package server
+
+import "errors"
+
+// RTUServer would serve Modbus RTU requests over a serial port against
+// Handler, the way TCPServer does for Modbus/TCP.
+type RTUServer struct {
+	Handler RequestHandler
+}
+
+// NewRTUServer is not implemented yet, for the same reason as
+// NewASCIIServer: RTU framing (silent-interval timing and CRC16) needs an
+// RTU Codec analogous to tcp.NewCodec, and this tree carries no RTU
+// packager to build one on top of.
+func NewRTUServer(port string, handler RequestHandler) (*RTUServer, error) {
+	return nil, errors.New("modbus: RTU server is not implemented in this tree yet")
+}
+
+// Serve always returns an error; see NewRTUServer.
+func (s *RTUServer) Serve() error {
+	return errors.New("modbus: RTU server is not implemented in this tree yet")
+}
+
+// Close is a no-op since Serve never starts.
+func (s *RTUServer) Close() error {
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package server
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+
+	modbus "github.com/OpenVoIP/modbus/pkg"
+	modbusTCP "github.com/OpenVoIP/modbus/pkg/tcp"
+)
+
+// TCPServer serves Modbus/TCP requests against Handler, accepting as many
+// concurrent client connections as the listener will give it: each
+// connection runs in its own goroutine.
+type TCPServer struct {
+	Handler RequestHandler
+	Logger  *log.Logger
+
+	listener net.Listener
+}
+
+// NewTCPServer starts listening on listen and returns a TCPServer ready to
+// Serve requests against handler.
+func NewTCPServer(listen string, handler RequestHandler) (*TCPServer, error) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPServer{Handler: handler, listener: ln}, nil
+}
+
+// Serve accepts connections until the listener is closed, at which point it
+// returns the Accept error (typically net.ErrClosed).
+func (s *TCPServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting new connections; connections already being served
+// run to completion.
+func (s *TCPServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *TCPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	// Only used for ReadFrame/DecodeADU: EncodeADU assigns its own
+	// transaction id on every call, which is right for a client issuing new
+	// requests but wrong for a server, which must echo the request's
+	// transaction id, so the response is built by hand below instead.
+	codec := modbusTCP.NewCodec(0)
+
+	for {
+		aduRequest, err := codec.ReadFrame(conn)
+		if err != nil {
+			s.logf("modbus: read frame error %+v", err)
+			return
+		}
+		unit, pdu, err := codec.DecodeADU(aduRequest)
+		if err != nil {
+			s.logf("modbus: decode request error %+v", err)
+			continue
+		}
+
+		response := s.dispatchRecover(unit, pdu)
+
+		aduResponse := make([]byte, 7+1+len(response.Data))
+		copy(aduResponse, aduRequest[:4]) // echo transaction id & protocol id
+		binary.BigEndian.PutUint16(aduResponse[4:], uint16(1+1+len(response.Data)))
+		aduResponse[6] = unit
+		aduResponse[7] = response.FunctionCode
+		copy(aduResponse[8:], response.Data)
+
+		if _, err := conn.Write(aduResponse); err != nil {
+			s.logf("modbus: write response error %+v", err)
+			return
+		}
+	}
+}
+
+// dispatchRecover runs dispatch and turns a panic (e.g. a handler or decoder
+// bug tripped by a malformed request) into a slave device failure exception
+// instead of taking down serveConn's goroutine, so one bad client can't
+// crash the connections other clients are depending on.
+func (s *TCPServer) dispatchRecover(unit byte, pdu *modbus.ProtocolDataUnit) (response *modbus.ProtocolDataUnit) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("modbus: panic dispatching request %+v", r)
+			response = exceptionPDU(pdu.FunctionCode, ExceptionSlaveDeviceFailure)
+		}
+	}()
+	return dispatch(s.Handler, unit, pdu)
+}
+
+func (s *TCPServer) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
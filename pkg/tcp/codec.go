@@ -0,0 +1,67 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	modbus "github.com/OpenVoIP/modbus/pkg"
+)
+
+// tcpCodec implements modbus.Codec for the length-prefixed Modbus Application
+// Protocol (MBAP) framing used over TCP. It wraps a tcpPackager so
+// Encode/Decode keep sharing its transaction id counter and SlaveId instead
+// of duplicating that state.
+type tcpCodec struct {
+	packager *tcpPackager
+}
+
+// NewCodec returns a modbus.Codec for Modbus/TCP framing, independent of any
+// TCPClientHandler. It is mainly useful to callers that only need to read
+// and decode MBAP frames, such as a server dispatching requests off raw
+// connections (see pkg/server).
+func NewCodec(slaveID byte) modbus.Codec {
+	return &tcpCodec{packager: &tcpPackager{SlaveId: slaveID}}
+}
+
+func (c *tcpCodec) EncodeADU(pdu *modbus.ProtocolDataUnit) ([]byte, error) {
+	return c.packager.Encode(pdu)
+}
+
+func (c *tcpCodec) DecodeADU(adu []byte) (unit byte, pdu *modbus.ProtocolDataUnit, err error) {
+	pdu, err = c.packager.Decode(adu)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(adu) > 6 {
+		unit = adu[6]
+	}
+	return unit, pdu, nil
+}
+
+// ReadFrame reads one MBAP frame: a 7-byte header (transaction id, protocol
+// id, length, unit id) followed by length-1 bytes of function code and data.
+func (c *tcpCodec) ReadFrame(r io.Reader) (adu []byte, err error) {
+	header := make([]byte, tcpHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length <= 0 {
+		return nil, fmt.Errorf("modbus: length in response header '%v' must not be zero", length)
+	}
+	if length > tcpMaxLength-(tcpHeaderSize-1) {
+		return nil, fmt.Errorf("modbus: length in response header '%v' must not be greater than '%v'", length, tcpMaxLength-tcpHeaderSize+1)
+	}
+
+	adu = make([]byte, tcpHeaderSize+length-1)
+	copy(adu, header)
+	if _, err = io.ReadFull(r, adu[tcpHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return adu, nil
+}
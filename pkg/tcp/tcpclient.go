@@ -5,11 +5,12 @@
 package tcp
 
 import (
+	"context"
 	"encoding/binary"
-	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -30,6 +31,33 @@ const (
 	tcpIdleTimeout = 60 * time.Second
 )
 
+// DefaultBackoffConfig is used by NewTCPClientHandler when no custom
+// BackoffConfig is supplied.
+var DefaultBackoffConfig = BackoffConfig{
+	BaseDelay: time.Second,
+	MaxDelay:  120 * time.Second,
+	Factor:    1.6,
+	Jitter:    0.2,
+}
+
+// BackoffConfig controls the delay Connect waits between reconnect attempts
+// after the connection is lost or cannot be established.
+type BackoffConfig struct {
+	// BaseDelay is the delay before the first retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the computed backoff delay.
+	MaxDelay time.Duration
+	// Factor is the multiplier applied to the delay after each failure.
+	Factor float64
+	// Jitter randomizes the delay by +/- this fraction of the computed
+	// delay, in the range [0, 1].
+	Jitter float64
+	// MaxRetries limits the number of consecutive failures Connect will
+	// tolerate before giving up and returning an error. Zero retries
+	// forever.
+	MaxRetries int
+}
+
 // TCPClientHandler implements Packager and Transporter interface.
 type TCPClientHandler struct {
 	tcpPackager
@@ -43,7 +71,9 @@ func NewTCPClientHandler(address string) *TCPClientHandler {
 	h.Address = address
 	h.Timeout = tcpTimeout
 	h.IdleTimeout = tcpIdleTimeout
+	h.Backoff = DefaultBackoffConfig
 	h.Stop = make(chan bool)
+	h.codec = &tcpCodec{packager: &h.tcpPackager}
 	return h
 }
 
@@ -72,8 +102,7 @@ func (mb *tcpPackager) Encode(pdu *modbus.ProtocolDataUnit) (adu []byte, err err
 	adu = make([]byte, tcpHeaderSize+1+len(pdu.Data))
 
 	// Transaction identifier
-	transactionId := atomic.AddUint32(&mb.transactionId, 1)
-	binary.BigEndian.PutUint16(adu, uint16(transactionId))
+	binary.BigEndian.PutUint16(adu, mb.nextTransactionId())
 	// Protocol identifier
 	binary.BigEndian.PutUint16(adu[2:], tcpProtocolIdentifier)
 	// Length = sizeof(SlaveId) + sizeof(FunctionCode) + Data
@@ -122,7 +151,8 @@ func (mb *tcpPackager) Decode(adu []byte) (pdu *modbus.ProtocolDataUnit, err err
 	length := binary.BigEndian.Uint16(adu[4:])
 	pduLength := len(adu) - tcpHeaderSize
 	if pduLength <= 0 || pduLength != int(length-1) {
-		mb.logf("modbus: length in response '%v' does not match pdu data length '%v'", length-1, pduLength)
+		err = fmt.Errorf("modbus: length in response '%v' does not match pdu data length '%v'", length-1, pduLength)
+		mb.logf("%v", err)
 		return
 	}
 	pdu = &modbus.ProtocolDataUnit{}
@@ -136,6 +166,18 @@ func (mb *tcpPackager) logf(format string, v ...interface{}) {
 	//utils.getLogger().Printf(format, v...)
 }
 
+// nextTransactionId returns the next transaction id, skipping 0: Received
+// treats id 0 as a server-initiated push (see tcpTransporter.Received), so a
+// real request must never be allocated it, not even on the uint16 wraparound
+// that atomic.AddUint32 eventually produces.
+func (mb *tcpPackager) nextTransactionId() uint16 {
+	for {
+		if id := uint16(atomic.AddUint32(&mb.transactionId, 1)); id != 0 {
+			return id
+		}
+	}
+}
+
 // tcpTransporter implements Transporter interface.
 type tcpTransporter struct {
 	// Connect string
@@ -147,25 +189,116 @@ type tcpTransporter struct {
 	// Transmission logger
 	Logger *log.Logger
 
-	// 服务端主动推送回调
+	// 服务端主动推送回调 (raw ADU). Kept for backward compatibility: Received
+	// falls back to it when a push's unit id has no RegisterPushHandler
+	// callback, or the push can't be decoded to a PDU.
 	Handle func([]byte)
 
+	// pushMu guards pushHandlers.
+	pushMu sync.RWMutex
+	// pushHandlers holds one decoded-push callback per unit id, registered
+	// via RegisterPushHandler.
+	pushHandlers map[byte]func(*modbus.ProtocolDataUnit)
+
+	// Backoff controls the delay between reconnect attempts made by Connect.
+	Backoff BackoffConfig
+
+	// dial opens the underlying connection. Overridable in tests; nil uses
+	// a plain net.Dialer.
+	dial func(address string) (net.Conn, error)
+
+	// codec owns ADU framing and encoding; Received reads frames through it
+	// instead of parsing the MBAP header itself.
+	codec modbus.Codec
+
 	// TCP connection
+	// mu guards conn, closeTimer, lastActivity, closing, retries, closeOnce
+	// and Error: connect()/Received() run on the reconnect-loop goroutine
+	// while Close()/SendContext() and the idle timer touch the same fields
+	// concurrently.
 	mu           sync.Mutex
 	conn         net.Conn
 	closeTimer   *time.Timer
 	lastActivity time.Time
-
+	closing      bool
+	retries      int
+	// closeOnce makes close() idempotent for the current connection attempt,
+	// so a second concurrent caller (e.g. closeIdle racing Received's own
+	// error path) can't send a second, spurious signal on Stop. Reset at the
+	// start of every Connect loop iteration.
+	closeOnce *sync.Once
+	// closeCh is closed by Close for the lifetime of one Connect call, so
+	// Connect's backoff sleep (and the top of its retry loop) can react to
+	// Close promptly even though closeOnce for the attempt that triggered
+	// the sleep has already fired and won't send on Stop again.
+	closeCh chan struct{}
+
+	// dataMu guards Data: Send/SendContext insert and delete entries while
+	// Received concurrently looks them up, so plain map access would race.
+	dataMu sync.RWMutex
 	// 将每次发出 Id 作 key, 接受响应为 value
 	Data map[uint16](chan []byte)
 
 	// 标记连接断开
-	Stop  chan bool
+	Stop chan bool
+	// Error is the last error that caused the connection to close, guarded
+	// by mu like the rest of the connection state.
 	Error error
 }
 
 // Send sends data to server and ensures response length is greater than header length.
+// It is equivalent to SendContext with a context bounded by the
+// transporter's Timeout (no deadline if Timeout is unset).
 func (mb *tcpTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	ctx := context.Background()
+	if mb.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mb.Timeout)
+		defer cancel()
+	}
+	return mb.SendContext(ctx, aduRequest)
+}
+
+// SendContext writes aduRequest and waits for its matching reply. Only the
+// write to the socket is serialized (see write); waiting for
+// the reply blocks solely on this request's own channel, so independent
+// requests can be in flight on the wire at the same time. ctx cancellation
+// or its deadline aborts the wait without affecting other pending requests.
+func (mb *tcpTransporter) SendContext(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	id := binary.BigEndian.Uint16(aduRequest)
+
+	replyCh := make(chan []byte, 1)
+	mb.dataMu.Lock()
+	mb.Data[id] = replyCh
+	mb.dataMu.Unlock()
+	defer func() {
+		mb.dataMu.Lock()
+		delete(mb.Data, id)
+		mb.dataMu.Unlock()
+		// Drain a reply that raced with cancellation/timeout so it isn't
+		// mistaken for the next request to reuse this transaction id.
+		select {
+		case <-replyCh:
+		default:
+		}
+	}()
+
+	if err = mb.write(aduRequest); err != nil {
+		return
+	}
+
+	// 等待数据
+	select {
+	case aduResponse = <-replyCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// write serializes writes to the connection; it is the only part of a
+// request that needs to hold mu, since the socket itself is single-writer.
+func (mb *tcpTransporter) write(aduRequest []byte) (err error) {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
@@ -173,96 +306,233 @@ func (mb *tcpTransporter) Send(aduRequest []byte) (aduResponse []byte, err error
 	mb.lastActivity = time.Now()
 	mb.startCloseTimer()
 
-	// Set write and read timeout
-	var timeout time.Time
+	// Set write timeout
+	var deadline time.Time
 	if mb.Timeout > 0 {
-		timeout = mb.lastActivity.Add(mb.Timeout)
+		deadline = mb.lastActivity.Add(mb.Timeout)
 	}
-	if err = mb.conn.SetDeadline(timeout); err != nil {
+	if err = mb.conn.SetWriteDeadline(deadline); err != nil {
 		return
 	}
-	// Send data
 	mb.logf("modbus: sending % x", aduRequest)
-	if _, err = mb.conn.Write(aduRequest); err != nil {
-		return
-	}
+	_, err = mb.conn.Write(aduRequest)
+	return
+}
 
-	// 等待数据
-	id := binary.BigEndian.Uint16(aduRequest)
-	mb.Data[id] = make(chan []byte, 1)
-	select {
-	case aduResponse = <-mb.Data[id]:
-		break
-	case <-time.After(time.Second * 3):
-		errStr := fmt.Sprintf("wait timeout %d", id)
-		err = errors.New(errStr)
+// RegisterPushHandler registers fn to receive server-initiated pushes
+// (transaction id 0) for unit, parsed into a PDU. Registering again for the
+// same unit replaces its handler, so a single connection can multiplex
+// distinct devices' push streams instead of funneling them all through
+// Handle. A push whose unit has no registered handler still reaches Handle.
+func (mb *tcpTransporter) RegisterPushHandler(unit byte, fn func(pdu *modbus.ProtocolDataUnit)) {
+	mb.pushMu.Lock()
+	defer mb.pushMu.Unlock()
+	if mb.pushHandlers == nil {
+		mb.pushHandlers = make(map[byte]func(*modbus.ProtocolDataUnit))
 	}
-	delete(mb.Data, id)
-	return
+	mb.pushHandlers[unit] = fn
 }
 
 // 处理服务端响应
 func (mb *tcpTransporter) Received(handler func(data []byte)) {
-	var err error
-	// Read header first
-	var data [tcpMaxLength]byte
+	mb.mu.Lock()
+	conn := mb.conn
+	mb.mu.Unlock()
 
 	for {
-		if _, err = io.ReadFull(mb.conn, data[:tcpHeaderSize]); err != nil {
-			mb.logf("read header error %+v", err)
+		aduResponse, err := mb.codec.ReadFrame(conn)
+		if err != nil {
+			// Behavior change from before the Codec refactor: a malformed
+			// frame (e.g. a bad length field) used to be flushed off the
+			// socket so the connection stayed up; now any ReadFrame error
+			// is treated as fatal and drops into a full backoff-reconnect
+			// cycle via close(). Simpler, but noisier links that used to
+			// shrug off an occasional garbled frame now pay a reconnect
+			// for it.
+			mb.logf("read frame error %+v", err)
+			mb.mu.Lock()
 			mb.Error = err
+			mb.mu.Unlock()
 			mb.close()
 			break
 		}
-		// Read length, ignore transaction & protocol id (4 bytes)
-		length := int(binary.BigEndian.Uint16(data[4:]))
-		if length <= 0 {
-			mb.flush(data[:])
-			mb.logf("modbus: length in response header '%v' must not be zero", length)
-			continue
-		}
-		if length > (tcpMaxLength - (tcpHeaderSize - 1)) {
-			mb.flush(data[:])
-			mb.logf("modbus: length in response header '%v' must not greater than '%v'", length, tcpMaxLength-tcpHeaderSize+1)
-			continue
-		}
-		// Skip unit id
-		length += tcpHeaderSize - 1
-		if _, err = io.ReadFull(mb.conn, data[tcpHeaderSize:length]); err != nil {
-			continue
-		}
-		aduResponse := data[:length]
+
+		// A full frame came through, so the connection is healthy again.
+		mb.mu.Lock()
+		mb.retries = 0
+		mb.mu.Unlock()
 
 		id := binary.BigEndian.Uint16(aduResponse)
 
 		// id 0 为主动推送
 		if id == 0 {
-			handler(aduResponse)
+			mb.dispatchPush(aduResponse, handler)
 		} else {
 			mb.logf("modbus: received % x\n", aduResponse)
-			mb.Data[id] <- aduResponse
+			mb.dataMu.RLock()
+			replyCh, ok := mb.Data[id]
+			mb.dataMu.RUnlock()
+			if ok {
+				// Buffered by one and only ever written here, so this
+				// never blocks; a caller who already gave up just won't
+				// see it (drained in SendContext's cleanup instead).
+				select {
+				case replyCh <- aduResponse:
+				default:
+				}
+			}
 		}
 	}
 }
 
-// Connect establishes a new connection to the address in Address.
+// dispatchPush routes an unsolicited push (transaction id 0) to the unit's
+// registered PDU handler, falling back to the raw-ADU handler when the push
+// can't be decoded or its unit has none registered.
+func (mb *tcpTransporter) dispatchPush(aduResponse []byte, handler func(data []byte)) {
+	unit, pdu, err := mb.codec.DecodeADU(aduResponse)
+	if err == nil {
+		mb.pushMu.RLock()
+		fn, ok := mb.pushHandlers[unit]
+		mb.pushMu.RUnlock()
+		if ok {
+			fn(pdu)
+			return
+		}
+	}
+	handler(aduResponse)
+}
+
+// Connect establishes a new connection to the address in Address and serves
+// it until the connection drops. If the connection cannot be established or
+// is lost, Connect automatically retries using Backoff (see BackoffConfig)
+// instead of returning, so callers no longer need their own reconnect loop.
+// Connect only returns once Close is called or, after a first failure,
+// Backoff.MaxRetries consecutive retries have failed as well.
 // Connect and Close are exported so that multiple requests can be done with one session
 func (mb *tcpTransporter) Connect() error {
-	go mb.connect()
-	<-mb.Stop
-	return mb.Error
+	mb.mu.Lock()
+	mb.closing = false
+	mb.retries = 0
+	mb.closeCh = make(chan struct{})
+	closeCh := mb.closeCh
+	mb.mu.Unlock()
+
+	for {
+		mb.mu.Lock()
+		if mb.closing {
+			err := mb.Error
+			mb.mu.Unlock()
+			return err
+		}
+		mb.closeOnce = &sync.Once{}
+		mb.mu.Unlock()
+
+		go mb.connect()
+		select {
+		case <-mb.Stop:
+		case <-closeCh:
+			// Close raced with this attempt's own dial/serve; its call to
+			// close() owns this attempt's closeOnce and will still send on
+			// Stop once it tears the connection down, so wait for that
+			// rather than returning while connect() may still be mutating
+			// mb.conn.
+			<-mb.Stop
+		}
+
+		mb.mu.Lock()
+		closing := mb.closing
+		retries := mb.retries
+		err := mb.Error
+		mb.mu.Unlock()
+		if closing {
+			return err
+		}
+		if mb.Backoff.MaxRetries > 0 && retries >= mb.Backoff.MaxRetries {
+			return err
+		}
+
+		delay := mb.nextBackoff()
+		mb.logf("modbus: reconnecting to %v in %v (attempt %d)", mb.Address, delay, retries+1)
+		select {
+		case <-time.After(delay):
+		case <-closeCh:
+			// No attempt is in flight during the backoff sleep, so this
+			// attempt's closeOnce already fired and Close's call to close()
+			// is a no-op beyond setting closing; return directly instead of
+			// waiting on Stop, which won't be sent again.
+			mb.mu.Lock()
+			err = mb.Error
+			mb.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// nextBackoff returns the delay before the next reconnect attempt, applying
+// exponential growth and jitter to Backoff, and advances the retry counter.
+func (mb *tcpTransporter) nextBackoff() time.Duration {
+	cfg := mb.Backoff
+	if cfg.BaseDelay <= 0 {
+		cfg = DefaultBackoffConfig
+	}
+
+	mb.mu.Lock()
+	retries := mb.retries
+	mb.retries++
+	mb.mu.Unlock()
+
+	delay := float64(cfg.BaseDelay) * math.Pow(cfg.Factor, float64(retries))
+	if max := float64(cfg.MaxDelay); cfg.MaxDelay > 0 && delay > max {
+		delay = max
+	}
+	if cfg.Jitter > 0 {
+		jitter := delay * cfg.Jitter
+		delay += jitter * (2*rand.Float64() - 1)
+		if delay < 0 {
+			delay = 0
+		}
+	}
+	return time.Duration(delay)
 }
 
 func (mb *tcpTransporter) connect() {
-	if mb.conn == nil {
-		dialer := net.Dialer{Timeout: mb.Timeout}
-		conn, err := dialer.Dial("tcp", mb.Address)
+	mb.mu.Lock()
+	if mb.closing {
+		mb.mu.Unlock()
+		mb.close()
+		return
+	}
+	needDial := mb.conn == nil
+	mb.mu.Unlock()
+
+	if needDial {
+		dial := mb.dial
+		if dial == nil {
+			dial = func(address string) (net.Conn, error) {
+				dialer := net.Dialer{Timeout: mb.Timeout}
+				return dialer.Dial("tcp", address)
+			}
+		}
+		conn, err := dial(mb.Address)
 		if err != nil {
+			mb.mu.Lock()
 			mb.Error = err
+			mb.mu.Unlock()
+			mb.close()
+			return
+		}
+
+		mb.mu.Lock()
+		if mb.closing {
+			// Close landed while we were dialing; don't hand a brand-new
+			// connection to Received after shutdown was requested.
+			mb.mu.Unlock()
+			conn.Close()
 			mb.close()
 			return
 		}
 		mb.conn = conn
+		mb.mu.Unlock()
 	}
 	mb.Received(mb.Handle)
 }
@@ -278,27 +548,21 @@ func (mb *tcpTransporter) startCloseTimer() {
 	}
 }
 
-// Close closes current connection.
+// Close closes current connection and stops Connect from reconnecting.
 func (mb *tcpTransporter) Close() error {
 	mb.mu.Lock()
-	defer mb.mu.Unlock()
-	return mb.close()
-}
-
-// flush flushes pending data in the connection,
-// returns io.EOF if connection is closed.
-func (mb *tcpTransporter) flush(b []byte) (err error) {
-	if err = mb.conn.SetReadDeadline(time.Now()); err != nil {
-		return
-	}
-	// Timeout setting will be reset when reading
-	if _, err = mb.conn.Read(b); err != nil {
-		// Ignore timeout error
-		if netError, ok := err.(net.Error); ok && netError.Timeout() {
-			err = nil
-		}
+	alreadyClosing := mb.closing
+	mb.closing = true
+	closeCh := mb.closeCh
+	mb.mu.Unlock()
+	// closeCh lets Connect's backoff sleep react to Close promptly even
+	// when close()'s per-attempt Stop signal has already been spent; guard
+	// it the same way closeOnce guards Stop, since Close may be called more
+	// than once or before Connect has ever run.
+	if !alreadyClosing && closeCh != nil {
+		close(closeCh)
 	}
-	return
+	return mb.close()
 }
 
 func (mb *tcpTransporter) logf(format string, v ...interface{}) {
@@ -307,25 +571,42 @@ func (mb *tcpTransporter) logf(format string, v ...interface{}) {
 	}
 }
 
-// closeLocked closes current connection. Caller must hold the mutex before calling this method.
+// close closes the current connection, if any, and signals Stop. It is
+// idempotent per connect attempt (guarded by closeOnce): Received's
+// error path and closeIdle can both race to close the same dead
+// connection, and only the first should actually send on Stop, since Stop
+// is unbuffered and a second send would block until Connect's next select
+// on Stop, which would misread it as the end of the following attempt.
 func (mb *tcpTransporter) close() (err error) {
-	if mb.conn != nil {
-		err = mb.conn.Close()
-		mb.conn = nil
+	mb.mu.Lock()
+	if mb.closeOnce == nil {
+		mb.closeOnce = &sync.Once{}
 	}
-	mb.Stop <- true
+	once := mb.closeOnce
+	mb.mu.Unlock()
+
+	once.Do(func() {
+		mb.mu.Lock()
+		if mb.conn != nil {
+			err = mb.conn.Close()
+			mb.conn = nil
+		}
+		mb.mu.Unlock()
+		mb.Stop <- true
+	})
 	return
 }
 
 // closeIdle closes the connection if last activity is passed behind IdleTimeout.
 func (mb *tcpTransporter) closeIdle() {
 	mb.mu.Lock()
-	defer mb.mu.Unlock()
-
 	if mb.IdleTimeout <= 0 {
+		mb.mu.Unlock()
 		return
 	}
 	idle := time.Since(mb.lastActivity)
+	mb.mu.Unlock()
+
 	if idle >= mb.IdleTimeout {
 		mb.logf("modbus: closing connection due to idle timeout: %v", idle)
 		mb.close()
@@ -0,0 +1,301 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	modbus "github.com/OpenVoIP/modbus/pkg"
+)
+
+// fakeConn is a minimal net.Conn whose Read blocks until either an error is
+// pushed on readErr or the connection is closed.
+type fakeConn struct {
+	readErr   chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		readErr: make(chan error, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) Read([]byte) (int, error) {
+	select {
+	case err := <-c.readErr:
+		return 0, err
+	case <-c.closed:
+		return 0, errors.New("fakeConn: closed")
+	}
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+func (c *fakeConn) LocalAddr() net.Addr              { return nil }
+func (c *fakeConn) RemoteAddr() net.Addr             { return nil }
+func (c *fakeConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestNextBackoff(t *testing.T) {
+	h := NewTCPClientHandler("fake")
+	h.Backoff = BackoffConfig{BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond, Factor: 2, Jitter: 0}
+
+	if got := h.nextBackoff(); got != 10*time.Millisecond {
+		t.Fatalf("1st retry delay = %v, want %v", got, 10*time.Millisecond)
+	}
+	if got := h.nextBackoff(); got != 20*time.Millisecond {
+		t.Fatalf("2nd retry delay = %v, want %v", got, 20*time.Millisecond)
+	}
+	if got := h.nextBackoff(); got != 40*time.Millisecond {
+		t.Fatalf("3rd retry delay = %v, want %v", got, 40*time.Millisecond)
+	}
+	if got := h.nextBackoff(); got != 80*time.Millisecond {
+		t.Fatalf("4th retry delay = %v, want %v", got, 80*time.Millisecond)
+	}
+	// 160ms would be next, but MaxDelay caps it.
+	if got := h.nextBackoff(); got != 100*time.Millisecond {
+		t.Fatalf("5th retry delay = %v, want capped %v", got, 100*time.Millisecond)
+	}
+}
+
+func TestNextBackoffJitter(t *testing.T) {
+	h := NewTCPClientHandler("fake")
+	h.Backoff = BackoffConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Factor: 1, Jitter: 0.2}
+
+	for i := 0; i < 50; i++ {
+		delay := h.nextBackoff()
+		if delay < 80*time.Millisecond || delay > 120*time.Millisecond {
+			t.Fatalf("delay %v out of expected +/-20%% jitter range", delay)
+		}
+	}
+}
+
+// TestConnectRetriesUntilDialSucceeds verifies that Connect retries through
+// a dialer that fails a fixed number of times before succeeding, and that
+// Close stops the retry loop for good.
+func TestConnectRetriesUntilDialSucceeds(t *testing.T) {
+	const failures = 3
+
+	h := NewTCPClientHandler("fake")
+	h.Backoff = BackoffConfig{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, Factor: 2, Jitter: 0}
+
+	var mu sync.Mutex
+	attempts := 0
+	conn := newFakeConn()
+	h.dial = func(string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts <= failures {
+			return nil, errors.New("dial failed")
+		}
+		return conn, nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- h.Connect() }()
+
+	deadline := time.After(time.Second)
+	for {
+		mu.Lock()
+		n := attempts
+		mu.Unlock()
+		if n > failures {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("dial only attempted %d times, want more than %d", n, failures)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	h.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Connect did not return after Close")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts <= failures {
+		t.Fatalf("attempts = %d, want more than %d", attempts, failures)
+	}
+}
+
+// TestCloseDuringBackoffSleepIsPrompt verifies that Close called while
+// Connect is sleeping between reconnect attempts returns promptly and
+// doesn't let Connect dial again, even though the failed attempt that put
+// Connect into the backoff sleep already spent its closeOnce.
+func TestCloseDuringBackoffSleepIsPrompt(t *testing.T) {
+	const backoffDelay = 200 * time.Millisecond
+
+	h := NewTCPClientHandler("fake")
+	h.Backoff = BackoffConfig{BaseDelay: backoffDelay, MaxDelay: time.Second, Factor: 2, Jitter: 0}
+
+	var mu sync.Mutex
+	attempts := 0
+	h.dial = func(string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return nil, errors.New("dial failed")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- h.Connect() }()
+
+	deadline := time.After(time.Second)
+	for {
+		mu.Lock()
+		n := attempts
+		mu.Unlock()
+		if n >= 1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("dial was never attempted")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	time.Sleep(10 * time.Millisecond) // let Connect settle into the backoff sleep
+
+	start := time.Now()
+	h.Close()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Connect did not return promptly after Close during backoff sleep")
+	}
+	if elapsed := time.Since(start); elapsed >= backoffDelay {
+		t.Fatalf("Connect took %v to return, want well under the %v backoff delay", elapsed, backoffDelay)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want exactly 1 (no dial after Close)", attempts)
+	}
+}
+
+// loopbackServer echoes a fixed ReadHoldingRegisters reply for every request
+// it reads off conn, preserving the request's transaction id and unit id.
+func loopbackServer(conn net.Conn) {
+	header := make([]byte, tcpHeaderSize)
+	respData := []byte{4, 0, 1, 0, 2} // byte count + 2 holding registers
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		body := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		resp := make([]byte, tcpHeaderSize+1+len(respData))
+		copy(resp, header[:4])
+		binary.BigEndian.PutUint16(resp[4:], uint16(1+1+len(respData)))
+		resp[6] = header[6]
+		resp[tcpHeaderSize] = 3
+		copy(resp[tcpHeaderSize+1:], respData)
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+// BenchmarkSendContextParallel issues many concurrent ReadHoldingRegisters
+// requests against a loopback fake server to demonstrate that pipelined
+// SendContext calls no longer serialize on the full round trip.
+func BenchmarkSendContextParallel(b *testing.B) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go loopbackServer(server)
+
+	h := NewTCPClientHandler("loopback")
+	h.SlaveId = 1
+	h.conn = client
+	go h.Received(func([]byte) {})
+
+	pdu := &modbus.ProtocolDataUnit{FunctionCode: 3, Data: []byte{0, 0, 0, 2}}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, err := h.Encode(pdu)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := h.SendContext(context.Background(), req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNextTransactionIdSkipsZero(t *testing.T) {
+	p := &tcpPackager{transactionId: 0xFFFFFFFF} // next atomic add wraps to 0
+	if id := p.nextTransactionId(); id == 0 {
+		t.Fatal("nextTransactionId returned 0, which Received reserves for pushes")
+	}
+}
+
+func TestDispatchPushRoutesToRegisteredHandler(t *testing.T) {
+	h := NewTCPClientHandler("fake")
+
+	var got *modbus.ProtocolDataUnit
+	h.RegisterPushHandler(5, func(pdu *modbus.ProtocolDataUnit) { got = pdu })
+
+	pdu := &modbus.ProtocolDataUnit{FunctionCode: 4, Data: []byte{1, 2}}
+	adu := make([]byte, tcpHeaderSize+1+len(pdu.Data))
+	binary.BigEndian.PutUint16(adu, 0)                             // transaction id 0 means unsolicited push
+	binary.BigEndian.PutUint16(adu[4:], uint16(1+1+len(pdu.Data))) // unit id + PDU length
+	adu[6] = 5
+	adu[tcpHeaderSize] = pdu.FunctionCode
+	copy(adu[tcpHeaderSize+1:], pdu.Data)
+
+	fallbackCalled := false
+	h.dispatchPush(adu, func([]byte) { fallbackCalled = true })
+
+	if got == nil || got.FunctionCode != 4 {
+		t.Fatalf("push handler not invoked with expected pdu, got %+v", got)
+	}
+	if fallbackCalled {
+		t.Fatal("fallback handler should not run when a push handler is registered")
+	}
+}
+
+func TestDispatchPushFallsBackWhenUnregistered(t *testing.T) {
+	h := NewTCPClientHandler("fake")
+
+	adu := make([]byte, tcpHeaderSize+1)
+	binary.BigEndian.PutUint16(adu[4:], 2) // unit id + function code, so the push decodes
+	adu[6] = 9                             // no handler registered for unit 9
+	adu[tcpHeaderSize] = 4
+
+	called := false
+	h.dispatchPush(adu, func([]byte) { called = true })
+	if !called {
+		t.Fatal("fallback handler should run when no push handler is registered for the unit")
+	}
+}
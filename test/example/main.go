@@ -19,21 +19,22 @@ func main() {
 	handler.SlaveId = 1
 	handler.Logger = utils.GetLogger()
 	handler.Handle = func(data []byte) {
-		// 主动上传数据
+		// 主动上传数据, unit 未注册 RegisterPushHandler 时的兜底
 		logger.Printf("handle %+v\n", data)
 	}
-
-	// Connect manually so that multiple requests are handled in one connection session
+	// Unit 1's pushes are parsed into a PDU instead of going through Handle.
+	handler.RegisterPushHandler(1, func(pdu *modbus.ProtocolDataUnit) {
+		logger.Printf("push from unit 1: function %v data %+v\n", pdu.FunctionCode, pdu.Data)
+	})
+
+	// Connect manually so that multiple requests are handled in one connection
+	// session. Connect retries internally with backoff, so it only returns
+	// once handler.Close() is called.
 	go func() {
-	reconnect:
 		err := handler.Connect()
 		if err != nil {
 			logger.Printf("Connect have error %+v\n", err)
 		}
-
-		time.Sleep(3 * time.Second)
-		goto reconnect
-
 	}()
 
 	go func() {